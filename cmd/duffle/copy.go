@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/docker/cnab-to-oci/remotes"
+	dref "github.com/docker/distribution/reference"
+	"github.com/spf13/cobra"
+)
+
+const copyUsage = `Copies a CNAB bundle, and every image it references, from one registry to another.
+
+No bundle artifacts are ever written to disk: the bundle manifest and its images are
+streamed directly from the source registry to the destination registry, mounting
+layers cross-repo when the two registries are the same so blobs aren't re-uploaded.
+
+remotes.Push pushes a freshly marshaled bundle.Bundle, not the original bytes a source
+bundle may have been clearsigned as, so copy always produces an unsigned bundle at the
+destination - the same as "duffle import" does when pushing to a registry. Of these
+commands, only "duffle bundle export" writes a signed bundle: it clearsigns the bundle
+file inside the .tgz it produces.
+`
+
+type copyCmd struct {
+	fromRef            string
+	toRef              string
+	insecureRegistries []string
+}
+
+func newCopyCmd(w io.Writer) *cobra.Command {
+	copy := &copyCmd{}
+
+	cmd := &cobra.Command{
+		Use:   "copy",
+		Short: "copy a CNAB bundle and its images from one registry to another",
+		Long:  copyUsage,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return copy.run()
+		},
+	}
+
+	f := cmd.Flags()
+	f.StringVar(&copy.fromRef, "from", "", "the bundle reference to copy from")
+	f.StringVar(&copy.toRef, "to", "", "the bundle reference to copy to")
+	f.StringSliceVar(&copy.insecureRegistries, "insecure-registries", nil, "Use plain HTTP for those registries")
+
+	return cmd
+}
+
+func (c *copyCmd) run() error {
+	if c.fromRef == "" || c.toRef == "" {
+		return fmt.Errorf("both --from and --to are required")
+	}
+
+	fromRef, err := dref.ParseNormalizedNamed(c.fromRef)
+	if err != nil {
+		return fmt.Errorf("%q is not a valid bundle reference: %v", c.fromRef, err)
+	}
+	toRef, err := dref.ParseNormalizedNamed(c.toRef)
+	if err != nil {
+		return fmt.Errorf("%q is not a valid bundle reference: %v", c.toRef, err)
+	}
+
+	ctx := context.Background()
+	resolver := createResolver(c.insecureRegistries).Resolver
+
+	b, err := remotes.Pull(ctx, fromRef, resolver)
+	if err != nil {
+		return fmt.Errorf("cannot pull bundle %s: %s", c.fromRef, err)
+	}
+
+	// FixupBundle rewrites every image in bun.Images/InvocationImages to point at
+	// toRef's repository and streams the underlying manifests and layers across,
+	// mounting layers cross-repo whenever the source and destination share a registry.
+	relocationMap, err := remotes.FixupBundle(ctx, b, toRef, resolver)
+	if err != nil {
+		return fmt.Errorf("cannot copy images to %s: %s", c.toRef, err)
+	}
+
+	if _, err := remotes.Push(ctx, b, relocationMap, toRef, resolver, true); err != nil {
+		return fmt.Errorf("cannot push bundle to %s: %s", c.toRef, err)
+	}
+
+	fmt.Fprintf(os.Stdout, "Copied %s to %s\n", c.fromRef, c.toRef)
+	return nil
+}
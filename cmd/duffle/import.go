@@ -0,0 +1,66 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/spf13/cobra"
+
+	"github.com/deislabs/duffle/pkg/packager"
+)
+
+const importUsage = `Imports a CNAB bundle archive produced by "duffle bundle export".
+
+By default, every image in the archive is loaded into the local Docker daemon.
+If --destination-registry is given, images and the bundle are pushed there
+instead, with the bundle's image references rewritten to match.
+`
+
+type importCmd struct {
+	source              string
+	destinationRegistry string
+	insecureRegistries  []string
+	insecure            bool
+}
+
+func newImportCmd(w io.Writer) *cobra.Command {
+	imp := &importCmd{}
+
+	cmd := &cobra.Command{
+		Use:   "import [bundle.tgz]",
+		Short: "import a CNAB bundle archive",
+		Long:  importUsage,
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			imp.source = args[0]
+			return imp.run()
+		},
+	}
+
+	f := cmd.Flags()
+	f.StringVar(&imp.destinationRegistry, "destination-registry", "", "push the bundle and its images here instead of loading them into the local Docker daemon")
+	f.StringSliceVar(&imp.insecureRegistries, "insecure-registries", nil, "Use plain HTTP for those registries")
+	f.BoolVar(&imp.insecure, "insecure", false, "don't verify the bundle's signature")
+
+	return cmd
+}
+
+func (imp *importCmd) run() error {
+	l, err := getLoader(homePath(), imp.insecure)
+	if err != nil {
+		return err
+	}
+
+	importer, err := packager.NewImporter(imp.source, imp.destinationRegistry, l, imp.insecureRegistries)
+	if err != nil {
+		return err
+	}
+
+	if err := importer.Import(); err != nil {
+		return err
+	}
+
+	fmt.Fprintf(os.Stdout, "Imported %s\n", imp.source)
+	return nil
+}
@@ -7,26 +7,34 @@ import (
 	"fmt"
 	"io"
 	"os"
+	"path/filepath"
 	"strings"
 
 	"github.com/docker/cli/cli/config"
 	"github.com/docker/cnab-to-oci/remotes"
 	dref "github.com/docker/distribution/reference"
 	"github.com/spf13/cobra"
+	"github.com/theupdateframework/notary/trustpinning"
 
 	"github.com/deislabs/duffle/pkg/bundle"
 	"github.com/deislabs/duffle/pkg/loader"
 	"github.com/deislabs/duffle/pkg/reference"
+	"github.com/deislabs/duffle/pkg/trust"
 )
 
 const pullUsage = `Pulls a CNAB bundle into the cache without installing it. `
 
+// defaultTrustServerURL is the Notary server duffle consults when --trusted
+// is set.
+const defaultTrustServerURL = "https://notary.docker.io"
+
 var ErrNotSigned = errors.New("bundle is not signed")
 
 type pullCmd struct {
 	output             string
 	targetRef          string
 	insecureRegistries []string
+	trusted            bool
 }
 
 func newPullCmd(w io.Writer) *cobra.Command {
@@ -44,6 +52,7 @@ func newPullCmd(w io.Writer) *cobra.Command {
 	f := cmd.Flags()
 	f.StringSliceVar(&pull.insecureRegistries, "insecure-registries", nil, "Use plain HTTP for those registries")
 	f.StringVarP(&pull.output, "output", "o", "", "output file")
+	f.BoolVar(&pull.trusted, "trusted", false, "only pull a bundle whose tag has been signed via Notary")
 
 	return cmd
 }
@@ -52,12 +61,47 @@ func createResolver(insecureRegistries []string) remotes.ResolverConfig {
 	return remotes.NewResolverConfigFromDockerConfigFile(config.LoadDefaultConfigFile(os.Stderr), insecureRegistries...)
 }
 
+// defaultTrustResolver returns the Notary-backed TrustResolver duffle uses
+// when a command is run with --trusted.
+func defaultTrustResolver() trust.TrustResolver {
+	trustDir := filepath.Join(homePath(), "trust")
+	return trust.NewNotaryResolver(defaultTrustServerURL, trustDir, filepath.Join(trustDir, "certs"), trustpinning.TrustPinConfig{})
+}
+
+// resolveTrustedRef rewrites named to point at the digest its tag was signed
+// with, so the caller can pull strictly by digest instead of trusting
+// whatever a registry happens to serve for that tag.
+func resolveTrustedRef(named dref.Named) (dref.Canonical, error) {
+	tagged, ok := named.(dref.NamedTagged)
+	if !ok {
+		return nil, fmt.Errorf("%q must be tagged to resolve trust data for it", named.String())
+	}
+
+	dgst, err := defaultTrustResolver().ResolveTag(tagged)
+	if err != nil {
+		if err == trust.ErrNoTrustData {
+			return nil, fmt.Errorf("no trust data for %s", tagged.String())
+		}
+		return nil, err
+	}
+
+	return dref.WithDigest(dref.TrimNamed(named), dgst)
+}
+
 func (p *pullCmd) run() error {
 	ref, err := dref.ParseNormalizedNamed(p.targetRef)
 	if err != nil {
 		return err
 	}
-	b, err := remotes.Pull(context.Background(), ref, createResolver(p.insecureRegistries).Resolver)
+
+	pullRef := ref
+	if p.trusted {
+		if pullRef, err = resolveTrustedRef(ref); err != nil {
+			return err
+		}
+	}
+
+	b, err := remotes.Pull(context.Background(), pullRef, createResolver(p.insecureRegistries).Resolver)
 	if err != nil {
 		return err
 	}
@@ -1,5 +1,12 @@
 package digester
 
+import (
+	"fmt"
+	"io"
+
+	"github.com/opencontainers/go-digest"
+)
+
 type Algorithm string
 
 const (
@@ -12,9 +19,36 @@ type Digester interface {
 }
 
 type digester struct {
-	alg Algorithm
+	alg    Algorithm
+	reader io.Reader
+}
+
+// NewDigester returns a Digester that computes the digest of everything read
+// from r using alg.
+func NewDigester(alg Algorithm, r io.Reader) Digester {
+	return &digester{alg: alg, reader: r}
 }
 
 func (d *digester) Digest() (string, error) {
-	return "sometempdigest", nil
+	canonical, err := d.canonicalAlgorithm()
+	if err != nil {
+		return "", err
+	}
+
+	dgst, err := canonical.FromReader(d.reader)
+	if err != nil {
+		return "", err
+	}
+	return dgst.String(), nil
+}
+
+func (d *digester) canonicalAlgorithm() (digest.Algorithm, error) {
+	switch d.alg {
+	case SHA256, "":
+		return digest.SHA256, nil
+	case SHA512:
+		return digest.SHA512, nil
+	default:
+		return "", fmt.Errorf("unsupported digest algorithm %q", d.alg)
+	}
 }
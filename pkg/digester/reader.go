@@ -0,0 +1,59 @@
+package digester
+
+import (
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+
+	"github.com/opencontainers/go-digest"
+)
+
+// ErrDigestMismatch is returned by a DigestingReader once it has been fully
+// read and the digest it computed doesn't match the digest it was told to
+// expect.
+type ErrDigestMismatch struct {
+	Expected digest.Digest
+	Actual   digest.Digest
+}
+
+func (e ErrDigestMismatch) Error() string {
+	return fmt.Sprintf("digest mismatch: expected %s, got %s", e.Expected, e.Actual)
+}
+
+// DigestingReader wraps a stream being pulled from a daemon or registry. It
+// tees every byte read into a running hash and, once the wrapped reader is
+// exhausted, compares the resulting digest against Expected. If Expected is
+// empty, no comparison is made and Actual simply records what was read.
+type DigestingReader struct {
+	Reader   io.Reader
+	Expected digest.Digest
+	Actual   digest.Digest
+
+	hash hash.Hash
+}
+
+// NewDigestingReader returns a DigestingReader that verifies r against
+// expected once r is fully read. expected may be empty, in which case the
+// reader just records the digest it computed rather than verifying it.
+func NewDigestingReader(r io.Reader, expected digest.Digest) *DigestingReader {
+	return &DigestingReader{
+		Reader:   r,
+		Expected: expected,
+		hash:     digest.Canonical.Hash(),
+	}
+}
+
+func (d *DigestingReader) Read(p []byte) (int, error) {
+	n, err := d.Reader.Read(p)
+	if n > 0 {
+		d.hash.Write(p[:n])
+	}
+	if err == io.EOF {
+		d.Actual = digest.NewDigestFromEncoded(digest.Canonical, hex.EncodeToString(d.hash.Sum(nil)))
+		if d.Expected != "" && d.Actual != d.Expected {
+			return n, ErrDigestMismatch{Expected: d.Expected, Actual: d.Actual}
+		}
+	}
+	return n, err
+}
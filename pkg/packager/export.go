@@ -8,59 +8,89 @@ import (
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"runtime"
 	"strings"
+	"sync"
 	"time"
 
-	"github.com/docker/docker/api/types"
-	"github.com/docker/docker/client"
+	dref "github.com/docker/distribution/reference"
 	"github.com/docker/docker/pkg/archive"
+	godigest "github.com/opencontainers/go-digest"
 
 	"github.com/deislabs/duffle/pkg/bundle"
+	"github.com/deislabs/duffle/pkg/digester"
 	"github.com/deislabs/duffle/pkg/loader"
 	"github.com/deislabs/duffle/pkg/signature"
+	"github.com/deislabs/duffle/pkg/trust"
 )
 
 type Exporter struct {
-	Source        string
-	Destination   string
-	Thin          bool
-	Client        *client.Client
-	Context       context.Context
-	Logs          string
-	Loader        loader.Loader
-	Unsigned      bool
-	Signer        string
-	SecretKeyRing string
+	Source              string
+	Destination         string
+	Thin                bool
+	Store               ImageStore
+	Context             context.Context
+	Logs                string
+	Loader              loader.Loader
+	Unsigned            bool
+	Signer              string
+	SecretKeyRing       string
+	AllowDigestMismatch bool
+	// Platforms, when non-empty, pulls one archive per "os/arch" entry
+	// (e.g. "linux/amd64") out of each image's manifest list instead of
+	// whatever the backend would pick by default.
+	Platforms []string
+	// Resolver, when set, is consulted to translate each image's tag into
+	// a signed digest before it's pulled, so Exporter fetches strictly by
+	// digest instead of trusting whatever a registry serves for that tag.
+	Resolver trust.TrustResolver
+	// Parallel caps how many images prepareArtifacts pulls and archives at
+	// once. Zero (the default from NewExporter's parallel arg) picks
+	// runtime.NumCPU() at Export time.
+	Parallel int
+	// Progress receives per-image start/progress/done callbacks while
+	// prepareArtifacts runs. Defaults to NopProgress.
+	Progress Progress
 }
 
 // NewExporter returns an *Exporter given information about where a bundle
 //  lives, where the compressed bundle should be exported to,
-//  and what form a bundle should be exported in (thin or thick/full). It also
-//  sets up a docker client to work with images.
-func NewExporter(source, dest, logsDir string, l loader.Loader, thin, unsigned bool, signer, secretKeyRing string) (*Exporter, error) {
-	cli, err := client.NewClientWithOpts(client.FromEnv)
+//  and what form a bundle should be exported in (thin or thick/full). Backend
+//  selects how images are fetched: "docker" (the default) pulls them through a
+//  running Docker daemon, while "oci" pulls them straight from the registry
+//  into an on-disk OCI image layout without a daemon. An empty platforms
+//  preserves the single-architecture export behavior. A nil resolver skips
+//  trust resolution and pulls images by tag, as before trust support existed.
+//  parallel caps how many images are pulled and archived concurrently; zero
+//  picks runtime.NumCPU(). A nil progress discards progress events.
+func NewExporter(source, dest, logsDir string, l loader.Loader, thin, unsigned bool, signer, secretKeyRing, backend string, allowDigestMismatch bool, platforms []string, resolver trust.TrustResolver, parallel int, progress Progress) (*Exporter, error) {
+	store, err := newImageStore(backend)
 	if err != nil {
 		return nil, err
 	}
-	ctx := context.Background()
-	cli.NegotiateAPIVersion(ctx)
-	if err != nil {
-		return nil, fmt.Errorf("cannot negotiate Docker client version: %v", err)
-	}
 
 	logs := filepath.Join(logsDir, "export-"+time.Now().Format("20060102150405"))
 
+	if progress == nil {
+		progress = NopProgress{}
+	}
+
 	return &Exporter{
-		Source:        source,
-		Destination:   dest,
-		Thin:          thin,
-		Client:        cli,
-		Context:       ctx,
-		Logs:          logs,
-		Loader:        l,
-		Unsigned:      unsigned,
-		Signer:        signer,
-		SecretKeyRing: secretKeyRing,
+		Source:              source,
+		Destination:         dest,
+		Thin:                thin,
+		Store:               store,
+		Context:             context.Background(),
+		Logs:                logs,
+		Loader:              l,
+		Unsigned:            unsigned,
+		Signer:              signer,
+		SecretKeyRing:       secretKeyRing,
+		AllowDigestMismatch: allowDigestMismatch,
+		Platforms:           platforms,
+		Resolver:            resolver,
+		Parallel:            parallel,
+		Progress:            progress,
 	}, nil
 }
 
@@ -98,7 +128,16 @@ func (ex *Exporter) Export() error {
 	if err := os.MkdirAll(archiveDir, 0755); err != nil {
 		return err
 	}
-	defer os.RemoveAll(archiveDir)
+	// archiveDir is only removed once Export has actually succeeded: on any
+	// error path it's left in place, along with .export-state.json, so a
+	// re-run can resume from whatever images it already archived instead of
+	// starting over.
+	succeeded := false
+	defer func() {
+		if succeeded {
+			os.RemoveAll(archiveDir)
+		}
+	}()
 
 	from, err := os.Open(ex.Source)
 	if err != nil {
@@ -157,75 +196,228 @@ func (ex *Exporter) Export() error {
 	}
 	defer rc.Close()
 
-	_, err = io.Copy(writer, rc)
-	return err
+	if _, err = io.Copy(writer, rc); err != nil {
+		return err
+	}
+
+	succeeded = true
+	return nil
+}
+
+// exportJob is one image's worth of work for prepareArtifacts: pull image
+// (previously declared with digest), and hand the reference it was actually
+// archived under - image itself, or its trust-resolved digest reference when
+// ex.Resolver is set - and the digest it was archived with back to apply
+// once Archive succeeds.
+type exportJob struct {
+	image  string
+	digest string
+	apply  func(image, digest string)
 }
 
-// prepareArtifacts pulls all images, verifies their digests (TODO: verify digest) and
-//  saves them to a directory called artifacts/ in the bundle directory
+// prepareArtifacts pulls all images, verifies their digests against whatever
+//  digest the bundle already declares, and saves them to a directory called
+//  artifacts/ in the bundle directory. Images with no declared digest have
+//  one computed and recorded so the resulting bundle.cnab is reproducible.
+//  Images are pulled by a pool of ex.Parallel workers (runtime.NumCPU() by
+//  default); progress is reported through ex.Progress as each one starts,
+//  advances and finishes. Completed images are recorded in archiveDir's
+//  .export-state.json so a re-run after a failure or interruption can skip
+//  them instead of re-pulling the whole bundle. Since bundle.Image only has
+//  room for a single Digest string, which gets the first platform's digest,
+//  every platform's digest, the first included, is also recorded in
+//  archiveDir's platform-digests.json.
 func (ex *Exporter) prepareArtifacts(bun *bundle.Bundle, archiveDir string, logs io.Writer) error {
 	artifactsDir := filepath.Join(archiveDir, "artifacts")
 	if err := os.MkdirAll(artifactsDir, 0755); err != nil {
 		return err
 	}
 
-	imagesWithShasums := map[string]bundle.Image{}
+	state, err := loadExportState(archiveDir)
+	if err != nil {
+		return err
+	}
+
+	pd, err := loadPlatformDigests(archiveDir)
+	if err != nil {
+		return err
+	}
+
+	var mu sync.Mutex // guards bun.Images and bun.InvocationImages
+	jobs := make([]exportJob, 0, len(bun.Images)+len(bun.InvocationImages))
+
 	for key, image := range bun.Images {
-		_, checksum, err := ex.archiveImage(image.Image, artifactsDir, logs)
-		if err != nil {
-			return err
-		}
+		key, image := key, image
+		jobs = append(jobs, exportJob{
+			image:  image.Image,
+			digest: image.Digest,
+			apply: func(resolvedImage, digest string) {
+				mu.Lock()
+				defer mu.Unlock()
+				img := bun.Images[key]
+				img.Image = resolvedImage
+				img.Digest = digest
+				bun.Images[key] = img
+			},
+		})
+	}
 
-		image.Digest = checksum
-		imagesWithShasums[key] = image
+	for i, in := range bun.InvocationImages {
+		i, in := i, in
+		jobs = append(jobs, exportJob{
+			image:  in.Image,
+			digest: in.Digest,
+			apply: func(resolvedImage, digest string) {
+				mu.Lock()
+				defer mu.Unlock()
+				bun.InvocationImages[i].Image = resolvedImage
+				bun.InvocationImages[i].Digest = digest
+			},
+		})
 	}
-	bun.Images = imagesWithShasums
 
-	invocationImagesWithShasums := []bundle.InvocationImage{}
-	for _, in := range bun.InvocationImages {
-		_, checksum, err := ex.archiveImage(in.Image, artifactsDir, logs)
+	parallel := ex.Parallel
+	if parallel <= 0 {
+		parallel = runtime.NumCPU()
+	}
+
+	serializedLogs := &serializedWriter{mu: &sync.Mutex{}, w: logs}
+	jobCh := make(chan exportJob)
+	var wg sync.WaitGroup
+	var stateMu sync.Mutex
+	var errOnce sync.Once
+	var firstErr error
+
+	for i := 0; i < parallel; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for job := range jobCh {
+				resolved, err := ex.resolveTrustedImage(job.image)
+				if err != nil {
+					ex.Progress.OnImageStart(job.image, 0)
+					ex.Progress.OnImageDone(job.image, err)
+					errOnce.Do(func() { firstErr = err })
+					continue
+				}
+
+				if digest, ok := state.completed(job.image); ok {
+					job.apply(resolved, digest)
+					continue
+				}
+
+				ex.Progress.OnImageStart(job.image, 0)
+				onProgress := func(bytesRead int64) {
+					ex.Progress.OnImageProgress(job.image, bytesRead)
+				}
+				digest, err := ex.archiveImage(resolved, job.digest, artifactsDir, pd, onProgress, serializedLogs)
+				ex.Progress.OnImageDone(job.image, err)
+				if err != nil {
+					errOnce.Do(func() { firstErr = err })
+					continue
+				}
+
+				job.apply(resolved, digest)
+				stateMu.Lock()
+				state.markComplete(job.image, digest)
+				stateMu.Unlock()
+			}
+		}()
+	}
+
+	for _, job := range jobs {
+		jobCh <- job
+	}
+	close(jobCh)
+	wg.Wait()
+
+	if err := state.save(archiveDir); err != nil && firstErr == nil {
+		firstErr = err
+	}
+	if err := pd.save(archiveDir); err != nil && firstErr == nil {
+		firstErr = err
+	}
+
+	return firstErr
+}
+
+// archiveImage pulls resolved - image itself, or its trust-resolved digest
+// reference when ex.Resolver is set, as already computed by the caller -
+// into artifactsDir once per entry in ex.Platforms (or once, platform-
+// unaware, when Platforms is empty). resolved is also what pd's entries and
+// the on-disk artifact filenames are keyed by, so that Import, which reads
+// the resolved reference back out of the written bundle.cnab, looks for
+// exactly the files archiveImage produced. The bundle's previously declared
+// digest, expectedDigest, is only meaningful for platforms[0]: bundle.Image
+// and bundle.InvocationImage carry a single Digest string, so that's the one
+// platform a re-export can compare against it. Every platform's own expected
+// digest otherwise comes from pd, which also receives every platform's
+// actual digest so later platforms are verified against their own prior run
+// rather than platforms[0]'s. A mismatch aborts the export unless
+// AllowDigestMismatch is set. archiveImage returns platforms[0]'s digest,
+// for the bundle's single Digest field; the rest live in pd. onProgress,
+// when non-nil, is forwarded to the backend so callers can report bytes
+// read as the pull happens.
+func (ex *Exporter) archiveImage(resolved, expectedDigest, artifactsDir string, pd *platformDigests, onProgress func(int64), logs io.Writer) (string, error) {
+	platforms := ex.Platforms
+	if len(platforms) == 0 {
+		platforms = []string{""}
+	}
+
+	firstDigest := ""
+	for i, platform := range platforms {
+		platformExpected := expectedDigest
+		if i > 0 {
+			platformExpected, _ = pd.get(resolved, platform)
+		}
+
+		_, actual, err := ex.Store.Archive(ex.Context, resolved, artifactsDir, platform, godigest.Digest(platformExpected), onProgress, logs)
 		if err != nil {
-			return err
+			if _, ok := err.(digester.ErrDigestMismatch); !ok || !ex.AllowDigestMismatch {
+				return "", fmt.Errorf("Error archiving image %s: %s", resolved, err)
+			}
 		}
-		in.Digest = checksum
-		invocationImagesWithShasums = append(invocationImagesWithShasums, in)
-	}
 
-	bun.InvocationImages = invocationImagesWithShasums
+		pd.set(resolved, platform, actual.String())
+		if i == 0 {
+			firstDigest = actual.String()
+		}
+	}
 
-	return nil
+	return firstDigest, nil
 }
 
-func (ex *Exporter) archiveImage(image, artifactsDir string, logs io.Writer) (string, string, error) {
-	ctx := ex.Context
+// resolveTrustedImage rewrites image to reference its signed digest when
+// ex.Resolver is set, so the export pulls strictly by digest instead of
+// trusting whatever a registry serves for the image's tag. With no
+// Resolver, image is returned unchanged.
+func (ex *Exporter) resolveTrustedImage(image string) (string, error) {
+	if ex.Resolver == nil {
+		return image, nil
+	}
 
-	imagePullOptions := types.ImagePullOptions{} //TODO: add platform info
-	pullLogs, err := ex.Client.ImagePull(ctx, image, imagePullOptions)
+	named, err := dref.ParseNormalizedNamed(image)
 	if err != nil {
-		return "", "", fmt.Errorf("Error pulling image %s: %s", image, err)
+		return "", fmt.Errorf("%q is not a valid image reference: %v", image, err)
+	}
+	tagged, ok := named.(dref.NamedTagged)
+	if !ok {
+		return "", fmt.Errorf("%q must be tagged to resolve trust data for it", image)
 	}
-	defer pullLogs.Close()
-	io.Copy(logs, pullLogs)
 
-	reader, err := ex.Client.ImageSave(ctx, []string{image})
+	dgst, err := ex.Resolver.ResolveTag(tagged)
 	if err != nil {
-		return "", "", err
+		if err == trust.ErrNoTrustData {
+			return "", fmt.Errorf("no trust data for %s", image)
+		}
+		return "", err
 	}
-	defer reader.Close()
-	//TODO: get checksum
 
-	name := buildFileName(image) + ".tar"
-	out, err := os.Create(filepath.Join(artifactsDir, name))
+	canonical, err := dref.WithDigest(dref.TrimNamed(named), dgst)
 	if err != nil {
-		return name, "", err
-	}
-	defer out.Close()
-	if _, err := io.Copy(out, reader); err != nil {
-		return name, "", err
+		return "", err
 	}
-
-	checksum := "tempchecksum"
-	return name, checksum, nil
+	return canonical.String(), nil
 }
 
 func buildFileName(uri string) string {
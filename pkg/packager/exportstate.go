@@ -0,0 +1,54 @@
+package packager
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+const exportStateFile = ".export-state.json"
+
+// exportState records the digest each image was archived with, so a re-run
+// of Export against the same archive directory can skip images it already
+// completed instead of re-pulling a partially exported bundle from scratch.
+type exportState struct {
+	Images map[string]string `json:"images"`
+}
+
+// loadExportState reads the state left behind by a previous, possibly
+// interrupted, Export in archiveDir. A missing file is not an error: it just
+// means there's nothing to resume.
+func loadExportState(archiveDir string) (*exportState, error) {
+	state := &exportState{Images: map[string]string{}}
+
+	data, err := ioutil.ReadFile(filepath.Join(archiveDir, exportStateFile))
+	if os.IsNotExist(err) {
+		return state, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, state); err != nil {
+		return nil, err
+	}
+	return state, nil
+}
+
+func (s *exportState) save(archiveDir string) error {
+	data, err := json.MarshalIndent(s, "", "\t")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(archiveDir, exportStateFile), data, 0644)
+}
+
+// completed reports the digest image was previously archived with, if any.
+func (s *exportState) completed(image string) (string, bool) {
+	digest, ok := s.Images[image]
+	return digest, ok
+}
+
+func (s *exportState) markComplete(image, digest string) {
+	s.Images[image] = digest
+}
@@ -0,0 +1,237 @@
+package packager
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/containers/image/v5/copy"
+	"github.com/containers/image/v5/docker"
+	"github.com/containers/image/v5/manifest"
+	ocilayout "github.com/containers/image/v5/oci/layout"
+	imgsignature "github.com/containers/image/v5/signature"
+	"github.com/containers/image/v5/types"
+	"github.com/docker/cli/cli/config"
+	dockertypes "github.com/docker/docker/api/types"
+	dockerclient "github.com/docker/docker/client"
+	godigest "github.com/opencontainers/go-digest"
+
+	"github.com/deislabs/duffle/pkg/digester"
+)
+
+// Backend names the ImageStore implementation an Exporter uses to fetch images.
+const (
+	BackendDocker = "docker"
+	BackendOCI    = "oci"
+)
+
+// ImageStore pulls an image and archives it to artifactsDir, returning the
+// archive's filename and the digest of the content that was written. When
+// expected is non-empty, Archive verifies the pulled content against it and
+// returns a digester.ErrDigestMismatch if they disagree. platform selects a
+// single entry out of a manifest list, in "os/arch" form; an empty platform
+// leaves the choice up to the backend's default. onProgress, when non-nil,
+// is called with the cumulative number of bytes read so far; it may be
+// called from a different goroutine than Archive was called from.
+type ImageStore interface {
+	Archive(ctx context.Context, image, artifactsDir, platform string, expected godigest.Digest, onProgress func(bytesRead int64), logs io.Writer) (filename string, actual godigest.Digest, err error)
+}
+
+// progressWriter reports the cumulative number of bytes written through it.
+type progressWriter struct {
+	onProgress func(int64)
+	total      int64
+}
+
+func (p *progressWriter) Write(b []byte) (int, error) {
+	p.total += int64(len(b))
+	p.onProgress(p.total)
+	return len(b), nil
+}
+
+// newImageStore returns the ImageStore for the given backend ("docker" or "oci").
+// An empty backend defaults to "docker" to preserve existing behavior.
+func newImageStore(backend string) (ImageStore, error) {
+	switch backend {
+	case "", BackendDocker:
+		return newDockerDaemonStore()
+	case BackendOCI:
+		return newOCIStore(), nil
+	default:
+		return nil, fmt.Errorf("unknown image store backend %q", backend)
+	}
+}
+
+// platformFileName builds the artifact filename for image, suffixing it with
+// platform (in "os-arch" form) when one was requested.
+func platformFileName(image, platform string) string {
+	name := buildFileName(image)
+	if platform == "" {
+		return name
+	}
+	return name + "-" + strings.Replace(platform, "/", "-", -1)
+}
+
+// splitPlatform splits a "os/arch" platform string into its parts.
+func splitPlatform(platform string) (os, arch string) {
+	parts := strings.SplitN(platform, "/", 2)
+	if len(parts) == 2 {
+		return parts[0], parts[1]
+	}
+	return parts[0], ""
+}
+
+// dockerDaemonStore pulls images through a running Docker daemon, exactly as
+// Exporter did before the OCI backend existed.
+type dockerDaemonStore struct {
+	client dockerclient.ImageAPIClient
+}
+
+func newDockerDaemonStore() (*dockerDaemonStore, error) {
+	cli, err := dockerclient.NewClientWithOpts(dockerclient.FromEnv)
+	if err != nil {
+		return nil, err
+	}
+	if err := cli.NegotiateAPIVersion(context.Background()); err != nil {
+		return nil, fmt.Errorf("cannot negotiate Docker client version: %v", err)
+	}
+	return &dockerDaemonStore{client: cli}, nil
+}
+
+func (s *dockerDaemonStore) Archive(ctx context.Context, image, artifactsDir, platform string, expected godigest.Digest, onProgress func(int64), logs io.Writer) (string, godigest.Digest, error) {
+	pullLogs, err := s.client.ImagePull(ctx, image, dockertypes.ImagePullOptions{Platform: platform})
+	if err != nil {
+		return "", "", fmt.Errorf("Error pulling image %s: %s", image, err)
+	}
+	defer pullLogs.Close()
+	io.Copy(logs, pullLogs)
+
+	reader, err := s.client.ImageSave(ctx, []string{image})
+	if err != nil {
+		return "", "", err
+	}
+	defer reader.Close()
+
+	name := platformFileName(image, platform) + ".tar"
+	archivePath := filepath.Join(artifactsDir, name)
+	out, err := os.Create(archivePath)
+	if err != nil {
+		return name, "", err
+	}
+	defer out.Close()
+
+	var dest io.Writer = out
+	if onProgress != nil {
+		dest = io.MultiWriter(out, &progressWriter{onProgress: onProgress})
+	}
+
+	dr := digester.NewDigestingReader(reader, expected)
+	if _, err := io.Copy(dest, dr); err != nil {
+		out.Close()
+		// A digest mismatch still leaves a complete, readable archive on
+		// disk - callers willing to tolerate the mismatch need that file to
+		// exist - so only remove archivePath for errors that actually left
+		// it truncated or otherwise unusable.
+		if _, ok := err.(digester.ErrDigestMismatch); !ok {
+			os.Remove(archivePath)
+		}
+		return name, dr.Actual, err
+	}
+
+	return name, dr.Actual, nil
+}
+
+// ociStore pulls images directly from a registry into an on-disk OCI image
+// layout, without ever talking to a Docker daemon. It's the backend that
+// makes Exporter usable in CI and serverless environments.
+type ociStore struct {
+	systemCtx *types.SystemContext
+}
+
+func newOCIStore() *ociStore {
+	return &ociStore{
+		systemCtx: &types.SystemContext{
+			AuthFilePath: filepath.Join(config.Dir(), config.ConfigFileName),
+		},
+	}
+}
+
+func (s *ociStore) Archive(ctx context.Context, image, artifactsDir, platform string, expected godigest.Digest, onProgress func(int64), logs io.Writer) (string, godigest.Digest, error) {
+	srcRef, err := docker.ParseReference("//" + image)
+	if err != nil {
+		return "", "", fmt.Errorf("cannot parse image reference %s: %s", image, err)
+	}
+
+	systemCtx := s.systemCtx
+	if platform != "" {
+		ctxCopy := *s.systemCtx
+		ctxCopy.OSChoice, ctxCopy.ArchitectureChoice = splitPlatform(platform)
+		systemCtx = &ctxCopy
+	}
+
+	name := platformFileName(image, platform)
+	layoutDir := filepath.Join(artifactsDir, "oci-layout:"+name)
+	destRef, err := ocilayout.ParseReference(layoutDir + ":" + name)
+	if err != nil {
+		return "", "", err
+	}
+
+	policyCtx, err := imgsignature.NewPolicyContext(&imgsignature.Policy{
+		Default: imgsignature.PolicyRequirements{imgsignature.NewPRInsecureAcceptAnything()},
+	})
+	if err != nil {
+		return "", "", err
+	}
+	defer policyCtx.Destroy()
+
+	var progressChan chan types.ProgressProperties
+	if onProgress != nil {
+		progressChan = make(chan types.ProgressProperties)
+		progressDone := make(chan struct{})
+		go func() {
+			defer close(progressDone)
+			// p.Offset is per blob, so sum each blob's latest offset to
+			// report the cumulative total across the whole image.
+			offsets := map[godigest.Digest]uint64{}
+			var total uint64
+			for p := range progressChan {
+				total += p.Offset - offsets[p.Artifact.Digest]
+				offsets[p.Artifact.Digest] = p.Offset
+				onProgress(int64(total))
+			}
+		}()
+		defer func() {
+			close(progressChan)
+			<-progressDone
+		}()
+	}
+
+	manifestBytes, err := copy.Image(ctx, policyCtx, destRef, srcRef, &copy.Options{
+		SourceCtx:        systemCtx,
+		ReportWriter:     logs,
+		Progress:         progressChan,
+		ProgressInterval: time.Second,
+	})
+	if err != nil {
+		return "", "", fmt.Errorf("Error pulling image %s: %s", image, err)
+	}
+
+	actual, err := manifest.Digest(manifestBytes)
+	if err != nil {
+		return "", "", fmt.Errorf("cannot compute digest of %s: %s", image, err)
+	}
+
+	// layoutDir is left in place even on a mismatch: it's a complete,
+	// readable OCI layout, and callers willing to tolerate the mismatch need
+	// it to still be there.
+	filename := filepath.Base(layoutDir)
+	if expected != "" && actual != expected {
+		return filename, actual, digester.ErrDigestMismatch{Expected: expected, Actual: actual}
+	}
+
+	return filename, actual, nil
+}
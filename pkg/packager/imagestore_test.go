@@ -0,0 +1,93 @@
+package packager
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/client"
+	godigest "github.com/opencontainers/go-digest"
+
+	"github.com/deislabs/duffle/pkg/digester"
+)
+
+// fakeImageAPIClient answers ImagePull and ImageSave from in-memory bytes so
+// dockerDaemonStore.Archive's digest verification can be exercised without a
+// running Docker daemon. It embeds client.ImageAPIClient so any method
+// dockerDaemonStore doesn't call is left unimplemented (nil-panicking if
+// ever invoked) rather than requiring a full fake of the interface.
+type fakeImageAPIClient struct {
+	client.ImageAPIClient
+	saveContent []byte
+}
+
+func (f *fakeImageAPIClient) ImagePull(ctx context.Context, image string, options types.ImagePullOptions) (io.ReadCloser, error) {
+	return ioutil.NopCloser(bytes.NewReader(nil)), nil
+}
+
+func (f *fakeImageAPIClient) ImageSave(ctx context.Context, images []string) (io.ReadCloser, error) {
+	return ioutil.NopCloser(bytes.NewReader(f.saveContent)), nil
+}
+
+func TestDockerDaemonStoreArchiveDigestMatches(t *testing.T) {
+	content := []byte("fake image tar content")
+	expected := godigest.Canonical.FromBytes(content)
+
+	dir, err := ioutil.TempDir("", "imagestore-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	store := &dockerDaemonStore{client: &fakeImageAPIClient{saveContent: content}}
+
+	_, actual, err := store.Archive(context.Background(), "example.com/repo:tag", dir, "", expected, nil, ioutil.Discard)
+	if err != nil {
+		t.Fatalf("Archive returned an error for a matching digest: %v", err)
+	}
+	if actual != expected {
+		t.Fatalf("got digest %s, want %s", actual, expected)
+	}
+}
+
+func TestDockerDaemonStoreArchiveDigestMismatch(t *testing.T) {
+	content := []byte("fake image tar content")
+	wrong := godigest.Canonical.FromBytes([]byte("not the same content"))
+
+	dir, err := ioutil.TempDir("", "imagestore-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	store := &dockerDaemonStore{client: &fakeImageAPIClient{saveContent: content}}
+
+	_, _, err = store.Archive(context.Background(), "example.com/repo:tag", dir, "", wrong, nil, ioutil.Discard)
+	if _, ok := err.(digester.ErrDigestMismatch); !ok {
+		t.Fatalf("expected digester.ErrDigestMismatch, got %v (%T)", err, err)
+	}
+}
+
+func TestDockerDaemonStoreArchiveNoExpectedDigest(t *testing.T) {
+	content := []byte("fake image tar content")
+
+	dir, err := ioutil.TempDir("", "imagestore-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	store := &dockerDaemonStore{client: &fakeImageAPIClient{saveContent: content}}
+
+	_, actual, err := store.Archive(context.Background(), "example.com/repo:tag", dir, "", "", nil, ioutil.Discard)
+	if err != nil {
+		t.Fatalf("Archive returned an error with no expected digest: %v", err)
+	}
+	if actual != godigest.Canonical.FromBytes(content) {
+		t.Fatalf("got digest %s, want the digest of the saved content", actual)
+	}
+}
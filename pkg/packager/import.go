@@ -0,0 +1,367 @@
+package packager
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/containerd/containerd/errdefs"
+	"github.com/docker/cli/cli/config"
+	"github.com/docker/cnab-to-oci/remotes"
+	distribution "github.com/docker/distribution"
+	"github.com/docker/distribution/manifest/manifestlist"
+	"github.com/docker/distribution/manifest/schema2"
+	"github.com/docker/distribution/reference"
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/client"
+	"github.com/docker/docker/pkg/archive"
+	"github.com/docker/docker/pkg/jsonmessage"
+	godigest "github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+
+	"github.com/deislabs/duffle/pkg/bundle"
+	"github.com/deislabs/duffle/pkg/digester"
+	"github.com/deislabs/duffle/pkg/loader"
+)
+
+// Importer is the inverse of Exporter: it takes a thick bundle .tgz produced
+// by Export and reloads its artifacts into a local daemon or, when
+// DestinationRef is set, pushes them on to a registry. It reads each artifact
+// as the <name>.tar archive the "docker" backend writes; the OCI image
+// layouts the "oci" backend writes are not read.
+type Importer struct {
+	Source         string
+	DestinationRef string
+	Client         client.ImageAPIClient
+	Context        context.Context
+	Loader         loader.Loader
+	Resolver       remotes.ResolverConfig
+}
+
+func createResolverConfig(insecureRegistries []string) remotes.ResolverConfig {
+	return remotes.NewResolverConfigFromDockerConfigFile(config.LoadDefaultConfigFile(os.Stderr), insecureRegistries...)
+}
+
+// NewImporter returns an *Importer for the bundle archive at source. When
+// destinationRef is non-empty, images and the bundle itself are pushed there
+// instead of being loaded into the local Docker daemon.
+func NewImporter(source, destinationRef string, l loader.Loader, insecureRegistries []string) (*Importer, error) {
+	cli, err := client.NewClientWithOpts(client.FromEnv)
+	if err != nil {
+		return nil, err
+	}
+	ctx := context.Background()
+	if err := cli.NegotiateAPIVersion(ctx); err != nil {
+		return nil, fmt.Errorf("cannot negotiate Docker client version: %v", err)
+	}
+
+	return &Importer{
+		Source:         source,
+		DestinationRef: destinationRef,
+		Client:         cli,
+		Context:        ctx,
+		Loader:         l,
+		Resolver:       createResolverConfig(insecureRegistries),
+	}, nil
+}
+
+// Import extracts the bundle, verifies its signature, then verifies and
+// reloads every artifact it declares. It fails loudly on the first
+// signature or digest failure; images loaded or pushed before that failure
+// are left in place, and the bundle itself is only pushed once every image
+// has been imported.
+func (im *Importer) Import() error {
+	extractDir, err := ioutil.TempDir("", "duffle-import-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(extractDir)
+
+	from, err := os.Open(im.Source)
+	if err != nil {
+		return err
+	}
+	defer from.Close()
+
+	if err := archive.Untar(from, extractDir, &archive.TarOptions{}); err != nil {
+		return fmt.Errorf("Error extracting %s: %s", im.Source, err)
+	}
+
+	bundlefile := filepath.Join(extractDir, "bundle.cnab")
+	if _, err := os.Stat(bundlefile); os.IsNotExist(err) {
+		bundlefile = filepath.Join(extractDir, "bundle.json")
+	}
+
+	bun, err := im.Loader.Load(bundlefile)
+	if err != nil {
+		return fmt.Errorf("cannot verify bundle: %s", err)
+	}
+
+	artifactsDir := filepath.Join(extractDir, "artifacts")
+
+	pd, err := loadPlatformDigests(extractDir)
+	if err != nil {
+		return fmt.Errorf("cannot read platform digests: %s", err)
+	}
+
+	relocationMap := map[string]string{}
+
+	for key, image := range bun.Images {
+		newRef, err := im.importImage(image.Image, image.Digest, artifactsDir, pd)
+		if err != nil {
+			return fmt.Errorf("Error importing image for %s: %s", key, err)
+		}
+		relocationMap[image.Image] = newRef
+	}
+	for i, in := range bun.InvocationImages {
+		newRef, err := im.importImage(in.Image, in.Digest, artifactsDir, pd)
+		if err != nil {
+			return fmt.Errorf("Error importing invocation image %s: %s", in.Image, err)
+		}
+		relocationMap[bun.InvocationImages[i].Image] = newRef
+	}
+
+	if im.DestinationRef == "" {
+		return nil
+	}
+
+	return im.pushBundle(bun, relocationMap)
+}
+
+// platformRef is one platform's locally-loaded image, produced by
+// importImage so pushImage knows what to push for each platform.
+type platformRef struct {
+	platform string
+	ref      string
+}
+
+// importImage loads every platform image was exported under - as recorded
+// in pd, or just the single legacy unsuffixed artifact when pd has no entry
+// for it - cross-checking each one's digest against what was recorded for
+// it, then either leaves them loaded into the local daemon or pushes them
+// to im.DestinationRef, returning the reference image now lives at.
+func (im *Importer) importImage(image, expectedDigest, artifactsDir string, pd *platformDigests) (string, error) {
+	platforms := pd.platforms(image)
+	if len(platforms) == 0 {
+		platforms = []string{""}
+	}
+
+	refs := make([]platformRef, 0, len(platforms))
+	for _, platform := range platforms {
+		digest := expectedDigest
+		if d, ok := pd.get(image, platform); ok {
+			digest = d
+		}
+
+		name := platformFileName(image, platform) + ".tar"
+		path := filepath.Join(artifactsDir, name)
+
+		if err := im.loadImageArchive(path, digest); err != nil {
+			return "", err
+		}
+
+		ref := image
+		if len(platforms) > 1 {
+			// docker load always restores the tar's own embedded reference,
+			// image, so loading a second platform under the same image
+			// would just overwrite the local pointer the previous platform
+			// left behind. Retagging immediately under a reference unique
+			// to this platform keeps every platform's image around for
+			// pushImage to find.
+			ref = platformFileName(image, platform)
+			if err := im.Client.ImageTag(im.Context, image, ref); err != nil {
+				return "", fmt.Errorf("cannot tag %s as %s: %s", image, ref, err)
+			}
+		}
+		refs = append(refs, platformRef{platform: platform, ref: ref})
+	}
+
+	if im.DestinationRef == "" {
+		return image, nil
+	}
+
+	return im.pushImage(image, refs)
+}
+
+// loadImageArchive verifies the tar at path against expectedDigest while
+// streaming it into the local Docker daemon.
+func (im *Importer) loadImageArchive(path, expectedDigest string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	dr := digester.NewDigestingReader(f, godigest.Digest(expectedDigest))
+
+	resp, err := im.Client.ImageLoad(im.Context, dr, false)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, resp.Body)
+
+	return nil
+}
+
+// pushImage pushes refs into the repository named by im.DestinationRef,
+// returning the reference the image now lives at. A single platform-
+// unaware ref is tagged and pushed exactly as a thin bundle always was.
+// Multiple refs are each pushed under their own platform-qualified tag and
+// then stitched into a manifest list tagged with image's own name, so the
+// destination repository ends up with one multi-arch reference instead of
+// whichever platform was pushed last silently winning.
+func (im *Importer) pushImage(image string, refs []platformRef) (string, error) {
+	destRepo, err := reference.ParseNormalizedNamed(im.DestinationRef)
+	if err != nil {
+		return "", fmt.Errorf("%q is not a valid destination registry: %v", im.DestinationRef, err)
+	}
+	newRef := destRepo.Name() + "/" + buildFileName(image)
+
+	if len(refs) == 1 && refs[0].platform == "" {
+		if _, _, err := im.pushTag(refs[0].ref, newRef); err != nil {
+			return "", err
+		}
+		return newRef, nil
+	}
+
+	descriptors := make([]manifestlist.ManifestDescriptor, 0, len(refs))
+	for _, r := range refs {
+		platformTag := newRef + "-" + strings.Replace(r.platform, "/", "-", -1)
+		digest, size, err := im.pushTag(r.ref, platformTag)
+		if err != nil {
+			return "", err
+		}
+
+		os, arch := splitPlatform(r.platform)
+		descriptors = append(descriptors, manifestlist.ManifestDescriptor{
+			Descriptor: distribution.Descriptor{
+				MediaType: schema2.MediaTypeManifest,
+				Digest:    digest,
+				Size:      size,
+			},
+			Platform: manifestlist.PlatformSpec{
+				Architecture: arch,
+				OS:           os,
+			},
+		})
+	}
+
+	ml, err := manifestlist.FromDescriptors(descriptors)
+	if err != nil {
+		return "", fmt.Errorf("cannot build manifest list for %s: %s", newRef, err)
+	}
+	_, payload, err := ml.Payload()
+	if err != nil {
+		return "", fmt.Errorf("cannot marshal manifest list for %s: %s", newRef, err)
+	}
+
+	if err := im.pushManifestList(newRef, payload); err != nil {
+		return "", err
+	}
+
+	return newRef, nil
+}
+
+// pushTag tags localRef as remoteTag and pushes it, reporting the digest
+// and size the registry recorded for it so pushImage can describe it in a
+// manifest list. The Docker Engine API reports these back as an "aux"
+// message on the push response stream rather than as a return value.
+func (im *Importer) pushTag(localRef, remoteTag string) (godigest.Digest, int64, error) {
+	if err := im.Client.ImageTag(im.Context, localRef, remoteTag); err != nil {
+		return "", 0, fmt.Errorf("cannot tag %s as %s: %s", localRef, remoteTag, err)
+	}
+
+	pushLogs, err := im.Client.ImagePush(im.Context, remoteTag, types.ImagePushOptions{RegistryAuth: "{}"})
+	if err != nil {
+		return "", 0, fmt.Errorf("Error pushing image %s: %s", remoteTag, err)
+	}
+	defer pushLogs.Close()
+
+	var result types.PushResult
+	dec := json.NewDecoder(pushLogs)
+	for {
+		var msg jsonmessage.JSONMessage
+		if err := dec.Decode(&msg); err != nil {
+			if err == io.EOF {
+				break
+			}
+			return "", 0, fmt.Errorf("Error reading push response for %s: %s", remoteTag, err)
+		}
+		if msg.Error != nil {
+			return "", 0, fmt.Errorf("Error pushing image %s: %s", remoteTag, msg.Error)
+		}
+		if msg.Aux != nil {
+			if err := json.Unmarshal(*msg.Aux, &result); err != nil {
+				return "", 0, fmt.Errorf("cannot parse push result for %s: %s", remoteTag, err)
+			}
+		}
+	}
+
+	if result.Digest == "" {
+		return "", 0, fmt.Errorf("registry did not return a digest for %s", remoteTag)
+	}
+
+	return godigest.Digest(result.Digest), result.Size, nil
+}
+
+// pushManifestList pushes payload, a manifest list's serialized JSON, to ref
+// using im.Resolver the same way pushBundle pushes a bundle's own manifest.
+func (im *Importer) pushManifestList(ref string, payload []byte) error {
+	pusher, err := im.Resolver.Resolver.Pusher(im.Context, ref)
+	if err != nil {
+		return fmt.Errorf("cannot resolve pusher for %s: %s", ref, err)
+	}
+
+	desc := ocispec.Descriptor{
+		MediaType: manifestlist.MediaTypeManifestList,
+		Digest:    godigest.FromBytes(payload),
+		Size:      int64(len(payload)),
+	}
+
+	writer, err := pusher.Push(im.Context, desc)
+	if err != nil {
+		if errdefs.IsAlreadyExists(err) {
+			return nil
+		}
+		return fmt.Errorf("cannot push manifest list to %s: %s", ref, err)
+	}
+	defer writer.Close()
+
+	if _, err := writer.Write(payload); err != nil {
+		return fmt.Errorf("cannot write manifest list to %s: %s", ref, err)
+	}
+	return writer.Commit(im.Context, desc.Size, desc.Digest)
+}
+
+// pushBundle rewrites bun's image references according to relocationMap and
+// pushes the resulting bundle to im.DestinationRef.
+func (im *Importer) pushBundle(bun *bundle.Bundle, relocationMap map[string]string) error {
+	destRef, err := reference.ParseNormalizedNamed(im.DestinationRef)
+	if err != nil {
+		return fmt.Errorf("%q is not a valid destination registry: %v", im.DestinationRef, err)
+	}
+
+	for key, image := range bun.Images {
+		if newRef, ok := relocationMap[image.Image]; ok {
+			image.Image = newRef
+			bun.Images[key] = image
+		}
+	}
+	for i, in := range bun.InvocationImages {
+		if newRef, ok := relocationMap[in.Image]; ok {
+			bun.InvocationImages[i].Image = newRef
+		}
+	}
+
+	if _, err := remotes.Push(im.Context, bun, nil, destRef, im.Resolver.Resolver, true); err != nil {
+		return fmt.Errorf("cannot push bundle to %s: %s", im.DestinationRef, err)
+	}
+
+	return nil
+}
@@ -0,0 +1,110 @@
+package packager
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+)
+
+const platformDigestsFile = "platform-digests.json"
+
+// platformDigests records the digest each image was archived with under
+// every platform it was archived for, including the platform-unaware ""
+// entry of a single-platform export. bundle.Image and bundle.InvocationImage
+// only carry a single Digest string, which holds the first platform's
+// digest; this sidecar file, saved alongside .export-state.json in
+// archiveDir, holds every platform's, the first included. Import reads it
+// back to find the right artifact file and expected digest for every
+// platform an image was exported with.
+type platformDigests struct {
+	mu     sync.Mutex
+	Images map[string]map[string]string `json:"images"`
+}
+
+// loadPlatformDigests reads the sidecar left behind by a previous Export of
+// archiveDir. A missing file just means no image has been archived there
+// yet, as with a thin bundle.
+func loadPlatformDigests(archiveDir string) (*platformDigests, error) {
+	pd := &platformDigests{Images: map[string]map[string]string{}}
+
+	data, err := ioutil.ReadFile(filepath.Join(archiveDir, platformDigestsFile))
+	if os.IsNotExist(err) {
+		return pd, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, pd); err != nil {
+		return nil, err
+	}
+	return pd, nil
+}
+
+func (pd *platformDigests) save(archiveDir string) error {
+	pd.mu.Lock()
+	defer pd.mu.Unlock()
+
+	if len(pd.Images) == 0 {
+		return nil
+	}
+	data, err := json.MarshalIndent(pd, "", "\t")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(archiveDir, platformDigestsFile), data, 0644)
+}
+
+// set records the digest image was archived with under platform. Safe to
+// call from multiple goroutines archiving different images concurrently.
+func (pd *platformDigests) set(image, platform, digest string) {
+	pd.mu.Lock()
+	defer pd.mu.Unlock()
+
+	platforms, ok := pd.Images[image]
+	if !ok {
+		platforms = map[string]string{}
+		pd.Images[image] = platforms
+	}
+	platforms[platform] = digest
+}
+
+// get reports the digest previously recorded for image under platform, if
+// any: either one left behind by an earlier, possibly interrupted export, or
+// one this same export already archived. Safe to call from multiple
+// goroutines archiving different images concurrently.
+func (pd *platformDigests) get(image, platform string) (string, bool) {
+	pd.mu.Lock()
+	defer pd.mu.Unlock()
+
+	platforms, ok := pd.Images[image]
+	if !ok {
+		return "", false
+	}
+	digest, ok := platforms[platform]
+	return digest, ok
+}
+
+// platforms reports every platform image was recorded under, sorted so ""
+// (the platform-unaware pull) sorts first when present. An image this
+// export never archived under any recorded platform - e.g. one from a thin
+// bundle, or a bundle.cnab written before platform-digests.json existed -
+// returns nil; callers should fall back to the legacy unsuffixed artifact
+// filename and the bundle's own Digest field.
+func (pd *platformDigests) platforms(image string) []string {
+	pd.mu.Lock()
+	defer pd.mu.Unlock()
+
+	m, ok := pd.Images[image]
+	if !ok {
+		return nil
+	}
+	platforms := make([]string, 0, len(m))
+	for platform := range m {
+		platforms = append(platforms, platform)
+	}
+	sort.Strings(platforms)
+	return platforms
+}
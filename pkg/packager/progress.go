@@ -0,0 +1,37 @@
+package packager
+
+import (
+	"io"
+	"sync"
+)
+
+// Progress lets a caller render per-image feedback while Exporter pulls and
+// archives several images concurrently. Exporter always passes a totalBytes
+// of 0: it does not determine an image's size before pulling it.
+type Progress interface {
+	OnImageStart(image string, totalBytes int64)
+	OnImageProgress(image string, bytesRead int64)
+	OnImageDone(image string, err error)
+}
+
+// NopProgress implements Progress by doing nothing. It's the default when a
+// caller doesn't care about progress events.
+type NopProgress struct{}
+
+func (NopProgress) OnImageStart(image string, totalBytes int64)   {}
+func (NopProgress) OnImageProgress(image string, bytesRead int64) {}
+func (NopProgress) OnImageDone(image string, err error)           {}
+
+// serializedWriter funnels writes from several goroutines through a single
+// io.Writer, so concurrent workers can share one log file without
+// interleaving partial writes.
+type serializedWriter struct {
+	mu *sync.Mutex
+	w  io.Writer
+}
+
+func (s *serializedWriter) Write(p []byte) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.w.Write(p)
+}
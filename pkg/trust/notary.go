@@ -0,0 +1,113 @@
+package trust
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+
+	"github.com/docker/distribution/reference"
+	"github.com/opencontainers/go-digest"
+	"github.com/theupdateframework/notary/client"
+	"github.com/theupdateframework/notary/trustpinning"
+	"github.com/theupdateframework/notary/tuf/data"
+)
+
+// NotaryResolver resolves tags to signed digests by consulting a Notary/TUF
+// trust server.
+type NotaryResolver struct {
+	ServerURL string
+	TrustDir  string
+	CertDir   string
+	Pinning   trustpinning.TrustPinConfig
+}
+
+// NewNotaryResolver returns a NotaryResolver that consults serverURL,
+// caching trust data under trustDir and pinning root certs from certDir.
+func NewNotaryResolver(serverURL, trustDir, certDir string, pinning trustpinning.TrustPinConfig) *NotaryResolver {
+	return &NotaryResolver{
+		ServerURL: serverURL,
+		TrustDir:  trustDir,
+		CertDir:   certDir,
+		Pinning:   pinning,
+	}
+}
+
+// ResolveTag consults the trust server for named's repository and returns
+// the digest it signed for named's tag.
+func (r *NotaryResolver) ResolveTag(named reference.NamedTagged) (digest.Digest, error) {
+	rt, err := certDirTransport(r.CertDir)
+	if err != nil {
+		return "", err
+	}
+
+	repo, err := client.NewFileCachedRepository(
+		r.TrustDir,
+		data.GUN(named.Name()),
+		r.ServerURL,
+		rt,
+		nil,
+		r.Pinning,
+	)
+	if err != nil {
+		return "", friendlyNotaryError(err)
+	}
+
+	target, err := repo.GetTargetByName(named.Tag())
+	if err != nil {
+		switch err.(type) {
+		case client.ErrNoSuchTarget, client.ErrRepositoryNotExist, client.ErrRepoNotInitialized:
+			return "", ErrNoTrustData
+		}
+		return "", friendlyNotaryError(err)
+	}
+
+	sha256, ok := target.Hashes["sha256"]
+	if !ok {
+		return "", ErrNoTrustData
+	}
+
+	return digest.NewDigestFromEncoded(digest.SHA256, hex.EncodeToString(sha256)), nil
+}
+
+// certDirTransport returns an http.RoundTripper that trusts only the root
+// certs found under certDir, so the TUF client's TLS connection to the
+// trust server is pinned to them instead of the system root store. An empty
+// certDir leaves the default transport (and its system roots) in place.
+func certDirTransport(certDir string) (http.RoundTripper, error) {
+	if certDir == "" {
+		return nil, nil
+	}
+
+	entries, err := ioutil.ReadDir(certDir)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read cert dir %s: %s", certDir, err)
+	}
+
+	pool := x509.NewCertPool()
+	for _, entry := range entries {
+		if entry.IsDir() {
+			continue
+		}
+		pem, err := ioutil.ReadFile(filepath.Join(certDir, entry.Name()))
+		if err != nil {
+			return nil, fmt.Errorf("cannot read cert %s: %s", entry.Name(), err)
+		}
+		pool.AppendCertsFromPEM(pem)
+	}
+
+	return &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool}}, nil
+}
+
+// friendlyNotaryError turns a raw JSON decode failure from the trust server
+// into something a user can act on, instead of a bare json.SyntaxError.
+func friendlyNotaryError(err error) error {
+	if _, ok := err.(*json.SyntaxError); ok {
+		return fmt.Errorf("trust server returned an unparseable response: %s", err)
+	}
+	return err
+}
@@ -0,0 +1,23 @@
+// Package trust provides an optional supply-chain layer on top of duffle's
+// OpenPGP bundle signing: translating a registry tag into the digest a trust
+// system has signed for it, so pulls can happen strictly by digest instead of
+// trusting whatever content a registry happens to serve for that tag.
+package trust
+
+import (
+	"errors"
+
+	"github.com/docker/distribution/reference"
+	"github.com/opencontainers/go-digest"
+)
+
+// ErrNoTrustData is returned when a TrustResolver has no signed trust data
+// for the requested tag. It's distinct from network/transport errors so
+// callers can tell "nobody signed this" from "couldn't reach the server".
+var ErrNoTrustData = errors.New("no trust data for tag")
+
+// TrustResolver translates a tagged reference into the digest a trust system
+// has signed for that tag.
+type TrustResolver interface {
+	ResolveTag(named reference.NamedTagged) (digest.Digest, error)
+}